@@ -0,0 +1,108 @@
+package ciphers_test
+
+import (
+	"bytes"
+	"testing"
+
+	_ "github.com/theorbtwo/phev2mqtt/ciphers"
+	"github.com/theorbtwo/phev2mqtt/protocol"
+)
+
+// registeredCiphers lists the ciphers this test round-trips packets
+// through. Add new firmware variants here as they're registered.
+var registeredCiphers = []string{"MY18", "null"}
+
+// makeFrame builds a valid plaintext frame of the given type carrying
+// payload, with the length field and trailing checksum byte filled
+// in.
+func makeFrame(typ byte, payload []byte) []byte {
+	msg := make([]byte, 3+len(payload)+1)
+	msg[0] = typ
+	msg[1] = byte(len(payload) + 2)
+	copy(msg[3:], payload)
+	msg[len(msg)-1] = protocol.Checksum(msg)
+	return msg
+}
+
+func TestCipherRoundTrip(t *testing.T) {
+	initPacket := []byte{0x5e, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09}
+	payload := []byte{0xaa, 0xbb, 0xcc}
+
+	for _, name := range registeredCiphers {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			sendCipher, err := protocol.NewCipher(name)
+			if err != nil {
+				t.Fatalf("NewCipher(%q) error = %v", name, err)
+			}
+			recvCipher, err := protocol.NewCipher(name)
+			if err != nil {
+				t.Fatalf("NewCipher(%q) error = %v", name, err)
+			}
+			if err := sendCipher.DeriveKeymap(initPacket); err != nil {
+				t.Fatalf("DeriveKeymap() error = %v", err)
+			}
+			if err := recvCipher.DeriveKeymap(initPacket); err != nil {
+				t.Fatalf("DeriveKeymap() error = %v", err)
+			}
+
+			for i := 0; i < 3; i++ {
+				plaintext := makeFrame(0x6f, payload)
+				key := sendCipher.SendKey(true)
+				encoded := protocol.XorMessageWith(plaintext, key)
+
+				got, _, _, err := protocol.ValidateAndDecodeMessage(recvCipher, encoded, nil)
+				if err != nil {
+					t.Fatalf("frame %d: ValidateAndDecodeMessage() error = %v", i, err)
+				}
+				if !bytes.Equal(got, plaintext) {
+					t.Fatalf("frame %d: got %x, want %x", i, got, plaintext)
+				}
+			}
+		})
+	}
+}
+
+// FuzzCipherRoundTrip round-trips arbitrary init packets and payloads
+// through every registered cipher, checking that whatever a cipher
+// encodes, the same cipher (freshly derived from the same init
+// packet) can decode.
+func FuzzCipherRoundTrip(f *testing.F) {
+	f.Add([]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c}, []byte("hello"))
+	f.Add([]byte{}, []byte{})
+	f.Add([]byte{0x5e}, []byte{0x00})
+
+	f.Fuzz(func(t *testing.T, initPacket, payload []byte) {
+		if len(payload) > 250 {
+			payload = payload[:250]
+		}
+		for _, name := range registeredCiphers {
+			sendCipher, err := protocol.NewCipher(name)
+			if err != nil {
+				t.Fatalf("NewCipher(%q) error = %v", name, err)
+			}
+			recvCipher, err := protocol.NewCipher(name)
+			if err != nil {
+				t.Fatalf("NewCipher(%q) error = %v", name, err)
+			}
+			if err := sendCipher.DeriveKeymap(initPacket); err != nil {
+				t.Fatalf("cipher %s: DeriveKeymap() error = %v", name, err)
+			}
+			if err := recvCipher.DeriveKeymap(initPacket); err != nil {
+				t.Fatalf("cipher %s: DeriveKeymap() error = %v", name, err)
+			}
+
+			plaintext := makeFrame(0x6f, payload)
+			key := sendCipher.SendKey(true)
+			encoded := protocol.XorMessageWith(plaintext, key)
+
+			got, _, _, err := protocol.ValidateAndDecodeMessage(recvCipher, encoded, nil)
+			if err != nil {
+				t.Fatalf("cipher %s: ValidateAndDecodeMessage() error = %v", name, err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Fatalf("cipher %s: got %x, want %x", name, got, plaintext)
+			}
+		}
+	})
+}
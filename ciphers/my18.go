@@ -0,0 +1,99 @@
+// Package ciphers provides protocol.Cipher implementations for the
+// various PHEV firmware variants.
+package ciphers
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theorbtwo/phev2mqtt/protocol"
+)
+
+func init() {
+	protocol.RegisterCipher("MY18", func() protocol.Cipher { return &MY18{} })
+}
+
+// MY18 implements the XOR/KSA-style keymap used by the "MY18"
+// (roughly, 2018-2020 model year) Outlander and Eclipse Cross PHEVs.
+//
+// The payload of the 0x5e/0x4e initialisation packets runs through
+// the algorithm in DeriveKeymap, which first derives a single security
+// key byte from the packet, then from that byte generates a key map:
+// an array of session keys which are rotated through as messages are
+// sent and received.
+type MY18 struct {
+	securityKey byte
+	keyMap      []byte
+	sNum, rNum  byte
+}
+
+func (c *MY18) DeriveKeymap(initPacket []byte) error {
+	if len(initPacket) < 12 {
+		c.Reset()
+		log.Debugf("%%PHEV_SEC_KEY_CLEAR%% Cleared security key")
+		return nil
+	}
+	// Calculate security key from provided packet.
+	result := (initPacket[4] & 0x8) >> 3
+	result |= (initPacket[5] & 0x8) >> 2
+	result |= (initPacket[6] & 0x8) >> 1
+	result |= (initPacket[7] & 0x8)
+	result |= (initPacket[8] & 0x8) << 1
+	result |= (initPacket[9] & 0x8) << 2
+	result |= (initPacket[10] & 0x8) << 3
+	result |= (initPacket[11] & 0x8) << 4
+	c.securityKey = byte(result)
+	// From this key, generate the key map.
+	s_key := int(c.securityKey)
+	c.keyMap = make([]byte, 256)
+	for i := 0; i < len(c.keyMap); i++ {
+		c.keyMap[i] = byte(i)
+	}
+
+	index := 0
+	for i := 0; i < 256; i++ {
+		index += int(c.keyMap[i])
+		index += s_key
+		index %= 256
+		temp := c.keyMap[i]
+		c.keyMap[i] = c.keyMap[index]
+		c.keyMap[index] = temp
+	}
+	// Reset the keymap send/receive indices.
+	c.sNum = 0
+	c.rNum = 0
+	log.Debugf("%%PHEV_SEC_KEY_UPDATE%% Updated security key")
+	return nil
+}
+
+func (c *MY18) RecvKey(advance bool) byte {
+	if len(c.keyMap) == 0 {
+		log.Tracef("r_key=empty")
+		return 0
+	}
+	ret := c.rNum
+	if advance {
+		c.rNum++
+	}
+	log.Tracef("r_key=%d", c.keyMap[ret])
+	return c.keyMap[ret]
+}
+
+func (c *MY18) SendKey(advance bool) byte {
+	if len(c.keyMap) == 0 {
+		log.Tracef("s_key=empty")
+		return 0
+	}
+	ret := c.sNum
+	if advance {
+		c.sNum++
+	}
+	log.Tracef("s_key=%d", c.keyMap[ret])
+	return c.keyMap[ret]
+}
+
+func (c *MY18) Reset() {
+	c.keyMap = []byte{}
+	c.securityKey = 0x0
+	c.sNum = 0
+	c.rNum = 0
+}
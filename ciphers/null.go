@@ -0,0 +1,18 @@
+package ciphers
+
+import "github.com/theorbtwo/phev2mqtt/protocol"
+
+func init() {
+	protocol.RegisterCipher("null", func() protocol.Cipher { return &Null{} })
+}
+
+// Null is a passthrough Cipher that never obscures anything: every key
+// byte is 0x0, so XORing with it is a no-op. It is useful for
+// replaying captured, already-plaintext traces in tests without
+// needing a real key schedule.
+type Null struct{}
+
+func (c *Null) DeriveKeymap(initPacket []byte) error { return nil }
+func (c *Null) SendKey(advance bool) byte            { return 0 }
+func (c *Null) RecvKey(advance bool) byte            { return 0 }
+func (c *Null) Reset()                               {}
@@ -0,0 +1,51 @@
+package protocol
+
+import "fmt"
+
+// Cipher implements the per-firmware keystream algorithm used to
+// obscure messages exchanged with the car. An implementation derives a
+// key schedule from the payload of a 0x5e/0x4e initialisation packet,
+// then hands out successive bytes of that schedule to XOR into the
+// send and receive directions independently.
+type Cipher interface {
+	// DeriveKeymap (re)initialises the cipher's key schedule from the
+	// payload of a 0x5e/0x4e initialisation packet. A packet shorter
+	// than the algorithm requires clears the schedule instead.
+	DeriveKeymap(initPacket []byte) error
+	// SendKey returns the next byte to XOR into a packet sent to the
+	// car. If advance is true, the send index is incremented
+	// afterwards.
+	SendKey(advance bool) byte
+	// RecvKey returns the next byte to XOR out of a packet received
+	// from the car. If advance is true, the receive index is
+	// incremented afterwards.
+	RecvKey(advance bool) byte
+	// Reset clears the key schedule, as if DeriveKeymap had never
+	// been called.
+	Reset()
+}
+
+// CipherFactory constructs a new, unkeyed Cipher instance.
+type CipherFactory func() Cipher
+
+var cipherRegistry = map[string]CipherFactory{}
+
+// RegisterCipher makes a Cipher implementation available by name, for
+// later construction with NewCipher. It is intended to be called from
+// the init() function of packages implementing Cipher, e.g.
+// the "ciphers" package.
+func RegisterCipher(name string, factory CipherFactory) {
+	cipherRegistry[name] = factory
+}
+
+// NewCipher constructs a new Cipher previously registered under name
+// with RegisterCipher. Callers normally blank-import the package
+// providing the desired cipher (e.g. phev2mqtt/ciphers) so its init()
+// has run.
+func NewCipher(name string) (Cipher, error) {
+	factory, ok := cipherRegistry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown cipher %q", name)
+	}
+	return factory(), nil
+}
@@ -0,0 +1,128 @@
+package protocol_test
+
+import (
+	"bytes"
+	"testing"
+
+	_ "github.com/theorbtwo/phev2mqtt/ciphers"
+	"github.com/theorbtwo/phev2mqtt/protocol"
+)
+
+// makeFrame builds a valid plaintext frame of the given type carrying
+// payload, with the length field and trailing checksum byte filled
+// in.
+func makeFrame(typ byte, payload []byte) []byte {
+	msg := make([]byte, 3+len(payload)+1)
+	msg[0] = typ
+	msg[1] = byte(len(payload) + 2)
+	copy(msg[3:], payload)
+	msg[len(msg)-1] = protocol.Checksum(msg)
+	return msg
+}
+
+// newSyncedCiphers returns a pair of freshly-derived MY18 ciphers, as
+// if one side had just sent a 0x5e/0x4e init packet and the other had
+// accepted it.
+func newSyncedCiphers(t *testing.T) (send, recv protocol.Cipher) {
+	t.Helper()
+	initPacket := []byte{0x5e, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09}
+
+	send, err := protocol.NewCipher("MY18")
+	if err != nil {
+		t.Fatalf("NewCipher() error = %v", err)
+	}
+	recv, err = protocol.NewCipher("MY18")
+	if err != nil {
+		t.Fatalf("NewCipher() error = %v", err)
+	}
+	if err := send.DeriveKeymap(initPacket); err != nil {
+		t.Fatalf("send.DeriveKeymap() error = %v", err)
+	}
+	if err := recv.DeriveKeymap(initPacket); err != nil {
+		t.Fatalf("recv.DeriveKeymap() error = %v", err)
+	}
+	return send, recv
+}
+
+func encodeFrame(t *testing.T, send protocol.Cipher, typ byte, payload []byte) []byte {
+	t.Helper()
+	plaintext := makeFrame(typ, payload)
+	key := send.SendKey(typ == 0x6f)
+	return protocol.XorMessageWith(plaintext, key)
+}
+
+func TestValidateAndDecodeMessage_InOrder(t *testing.T) {
+	send, recv := newSyncedCiphers(t)
+	for i := 0; i < 5; i++ {
+		encoded := encodeFrame(t, send, 0x6f, []byte{byte(i)})
+		got, _, _, err := protocol.ValidateAndDecodeMessage(recv, encoded, nil)
+		if err != nil {
+			t.Fatalf("frame %d: unexpected error: %v", i, err)
+		}
+		if got[0] != 0x6f || got[3] != byte(i) {
+			t.Fatalf("frame %d: got %x", i, got)
+		}
+	}
+}
+
+func TestValidateAndDecodeMessage_NonAdvancingFrameTypeNeverDesyncs(t *testing.T) {
+	send, recv := newSyncedCiphers(t)
+	// A frame whose type is not 0x6f doesn't advance either side's
+	// index, so replaying the same key should never desync.
+	for i := 0; i < 3; i++ {
+		encoded := encodeFrame(t, send, 0x10, []byte{0xaa})
+		if _, _, _, err := protocol.ValidateAndDecodeMessage(recv, encoded, nil); err != nil {
+			t.Fatalf("iteration %d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestValidateAndDecodeMessage_DroppedFrameDesyncs(t *testing.T) {
+	send, recv := newSyncedCiphers(t)
+	encodeFrame(t, send, 0x6f, []byte{0x01}) // dropped, never delivered to recv
+	second := encodeFrame(t, send, 0x6f, []byte{0x02})
+
+	var gotDesync bool
+	onDesync := func(got, want byte) { gotDesync = true }
+	if _, _, _, err := protocol.ValidateAndDecodeMessage(recv, second, onDesync); err != protocol.ErrKeyDesync {
+		t.Fatalf("err = %v, want ErrKeyDesync", err)
+	}
+	if !gotDesync {
+		t.Errorf("onDesync callback was not invoked")
+	}
+}
+
+func TestValidateAndDecodeMessage_ReplayedFrameDesyncs(t *testing.T) {
+	send, recv := newSyncedCiphers(t)
+	first := encodeFrame(t, send, 0x6f, []byte{0x01})
+	if _, _, _, err := protocol.ValidateAndDecodeMessage(recv, first, nil); err != nil {
+		t.Fatalf("first delivery: unexpected error: %v", err)
+	}
+	// recv's index has already advanced past this frame.
+	if _, _, _, err := protocol.ValidateAndDecodeMessage(recv, first, nil); err != protocol.ErrKeyDesync {
+		t.Fatalf("replay: err = %v, want ErrKeyDesync", err)
+	}
+}
+
+func TestValidateAndDecodeMessage_OutOfOrderFrameDesyncs(t *testing.T) {
+	send, recv := newSyncedCiphers(t)
+	_ = encodeFrame(t, send, 0x6f, []byte{0x01})
+	second := encodeFrame(t, send, 0x6f, []byte{0x02})
+
+	if _, _, _, err := protocol.ValidateAndDecodeMessage(recv, second, nil); err != protocol.ErrKeyDesync {
+		t.Fatalf("out-of-order delivery: err = %v, want ErrKeyDesync", err)
+	}
+}
+
+func TestValidateAndDecodeMessage_NilCipherSkipsDesyncCheck(t *testing.T) {
+	plaintext := makeFrame(0x6f, []byte{0xaa})
+	encoded := protocol.XorMessageWith(plaintext, 0x42)
+
+	got, xor, _, err := protocol.ValidateAndDecodeMessage(nil, encoded, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if xor != 0x42 || !bytes.Equal(got, plaintext) {
+		t.Fatalf("got = %x, xor = %#x", got, xor)
+	}
+}
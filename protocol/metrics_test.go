@@ -0,0 +1,45 @@
+package protocol_test
+
+import (
+	"testing"
+
+	"github.com/theorbtwo/phev2mqtt/protocol"
+)
+
+// TestDecryptCounters checks that ValidateAndDecodeMessage actually
+// advances the phev_decrypt_badsum_total and phev_decrypt_desync_total
+// counters it backs, so a future refactor of the increment sites
+// doesn't silently break them even though nothing in this tree
+// exports them yet.
+func TestDecryptCounters(t *testing.T) {
+	send, recv := newSyncedCiphers(t)
+	badsumBefore := protocol.DecryptBadsumTotal()
+	desyncBefore := protocol.DecryptDesyncTotal()
+
+	// Corrupt the checksum byte of an otherwise valid frame: it should
+	// fail to decode under both the direct and parity-flipped xor
+	// guesses and count as a bad sum. Peek the send key rather than
+	// advancing it, since this frame is never successfully delivered
+	// and shouldn't consume a slot in the key schedule.
+	badFrame := protocol.XorMessageWith(makeFrame(0x6f, []byte{0x01}), send.SendKey(false))
+	badFrame[len(badFrame)-1] ^= 0xff
+	if got, _, _, err := protocol.ValidateAndDecodeMessage(recv, badFrame, nil); err != nil || got != nil {
+		t.Fatalf("ValidateAndDecodeMessage(corrupted frame) = (%x, err=%v), want (nil, nil)", got, err)
+	}
+	if got, want := protocol.DecryptBadsumTotal(), badsumBefore+1; got != want {
+		t.Errorf("DecryptBadsumTotal() = %d, want %d", got, want)
+	}
+
+	// Replaying an already-delivered frame should fail the key
+	// schedule check and count as a desync.
+	goodFrame := encodeFrame(t, send, 0x6f, []byte{0x02})
+	if _, _, _, err := protocol.ValidateAndDecodeMessage(recv, goodFrame, nil); err != nil {
+		t.Fatalf("first delivery: unexpected error: %v", err)
+	}
+	if _, _, _, err := protocol.ValidateAndDecodeMessage(recv, goodFrame, nil); err != protocol.ErrKeyDesync {
+		t.Fatalf("replay: err = %v, want ErrKeyDesync", err)
+	}
+	if got, want := protocol.DecryptDesyncTotal(), desyncBefore+1; got != want {
+		t.Errorf("DecryptDesyncTotal() = %d, want %d", got, want)
+	}
+}
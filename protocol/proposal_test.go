@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"bytes"
+	cryptorand "crypto/rand"
+	"testing"
+)
+
+func TestGenerateProposal(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  []byte
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name:   "deterministic reader reproduces proposal",
+			source: []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+			want:   []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+		},
+		{
+			name:   "another deterministic reader reproduces its own proposal",
+			source: bytes.Repeat([]byte{0xab}, 8),
+			want:   bytes.Repeat([]byte{0xab}, 8),
+		},
+		{
+			name:    "short reader returns an error",
+			source:  []byte{0x01, 0x02, 0x03},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer SetRandSource(cryptorand.Reader)
+			SetRandSource(bytes.NewReader(tt.source))
+
+			s := &SecurityKey{}
+			got, err := s.GenerateProposal()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GenerateProposal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("GenerateProposal() = %x, want %x", got, tt.want)
+			}
+			if s.State != SecurityKeyProposed {
+				t.Errorf("State = %v, want SecurityKeyProposed", s.State)
+			}
+		})
+	}
+}
+
+// TestGenerateProposalUnique checks that, using the real crypto/rand
+// source, repeated proposals don't collide.
+func TestGenerateProposalUnique(t *testing.T) {
+	s := &SecurityKey{}
+	seen := make(map[string]bool)
+	const iterations = 10000
+	for i := 0; i < iterations; i++ {
+		got, err := s.GenerateProposal()
+		if err != nil {
+			t.Fatalf("GenerateProposal() error = %v", err)
+		}
+		key := string(got)
+		if seen[key] {
+			t.Fatalf("GenerateProposal() returned duplicate proposal %x after %d of %d iterations", got, i, iterations)
+		}
+		seen[key] = true
+	}
+}
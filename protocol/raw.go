@@ -1,11 +1,60 @@
 package protocol
 
 import (
+	cryptorand "crypto/rand"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+
 	log "github.com/sirupsen/logrus"
-	"math/rand"
 )
 
+// ErrKeyDesync is returned by ValidateAndDecodeMessage when a frame's
+// key byte does not match the expected position in the receive key
+// schedule. This happens when a frame is replayed, reordered, or a
+// frame in between was dropped, and means the caller can no longer
+// trust that its key schedule is in step with the car's; it should
+// stop trusting the frame and trigger a re-handshake.
+var ErrKeyDesync = errors.New("protocol: received frame key does not match expected key schedule")
+
+// DesyncFunc is called by ValidateAndDecodeMessage whenever it detects
+// a key desync, so that the caller can react, e.g. by re-sending a
+// 0x5e init packet to re-handshake.
+type DesyncFunc func(got, want byte)
+
+// decryptDesyncTotal and decryptBadsumTotal back the
+// phev_decrypt_desync_total and phev_decrypt_badsum_total metrics.
+// There is no MQTT/Prometheus bridge in this tree yet to poll and
+// export them; that wiring belongs wherever that bridge lives.
+var (
+	decryptDesyncTotal uint64
+	decryptBadsumTotal uint64
+)
+
+// DecryptDesyncTotal returns the number of frames rejected so far for
+// failing the key schedule desync check, for exposing as the
+// phev_decrypt_desync_total metric.
+func DecryptDesyncTotal() uint64 { return atomic.LoadUint64(&decryptDesyncTotal) }
+
+// DecryptBadsumTotal returns the number of frames rejected so far for
+// failing the checksum, for exposing as the phev_decrypt_badsum_total
+// metric.
+func DecryptBadsumTotal() uint64 { return atomic.LoadUint64(&decryptBadsumTotal) }
+
+// randSource is the source of randomness used by GenerateProposal. It
+// defaults to crypto/rand, but can be overridden with SetRandSource so
+// that tests can inject a deterministic reader.
+var randSource io.Reader = cryptorand.Reader
+
+// SetRandSource overrides the source of randomness used when proposing
+// session keys. It exists primarily so that tests can substitute a
+// deterministic reader; production code should not normally call this.
+func SetRandSource(r io.Reader) {
+	randSource = r
+}
+
 type SecurityState int
 
 const (
@@ -14,112 +63,80 @@ const (
 	SecurityKeyAccepted
 )
 
-// SecurityKey implements the algorithm for the session encoding/decoding
-// keys.
+// SecurityKey drives the session key negotiation handshake (proposing
+// and accepting an 8-byte session key with the car) and, once
+// accepted, delegates the resulting keystream to a Cipher.
 type SecurityKey struct {
 	State       SecurityState
 	proposedKey []byte
-	securityKey byte
-	keyMap      []byte
-	sNum, rNum  byte
+	cipher      Cipher
+}
+
+// NewSecurityKey creates a SecurityKey that derives and applies its
+// keystream using cipher, e.g. one built with NewCipher.
+func NewSecurityKey(cipher Cipher) *SecurityKey {
+	return &SecurityKey{cipher: cipher}
 }
 
-func (s *SecurityKey) GenerateProposal() []byte {
+// GenerateProposal picks a fresh random 8-byte session key proposal.
+// Proposals must be unpredictable: an attacker who can guess the
+// proposed key can derive the resulting key map and decode the
+// session, so the key is read from randSource (crypto/rand by
+// default) rather than a seedless math/rand generator.
+func (s *SecurityKey) GenerateProposal() ([]byte, error) {
 	s.proposedKey = make([]byte, 8)
-	for i := 0; i < 8; i++ {
-		s.proposedKey[i] = byte(rand.Intn(256))
+	if _, err := io.ReadFull(randSource, s.proposedKey); err != nil {
+		return nil, fmt.Errorf("generating session key proposal: %w", err)
 	}
 	s.State = SecurityKeyProposed
-	return s.proposedKey
+	return s.proposedKey, nil
 }
 
-func (s *SecurityKey) AcceptProposal() {
-	s.Update(append([]byte{0x0, 0x0, 0x0, 0x0}, s.proposedKey...))
+func (s *SecurityKey) AcceptProposal() error {
+	if err := s.Update(append([]byte{0x0, 0x0, 0x0, 0x0}, s.proposedKey...)); err != nil {
+		return err
+	}
 	s.State = SecurityKeyAccepted
+	return nil
 }
 
-// Generate the security keys from the 0x5e/0x4e initialisation
-// packets. The payload for these packets runs through the below
-// algorithm which initially generates a security key from the data,
-// then from this security key a key map is generated, essentially
-// an array of session keys which are rotated through.
-func (s *SecurityKey) Update(packet []byte) {
-	if len(packet) < 12 {
-		s.keyMap = []byte{} // Clear security keys.
-		s.securityKey = 0x0
-		s.sNum = 0
-		s.rNum = 0
-		log.Debugf("%%PHEV_SEC_KEY_CLEAR%% Cleared security key")
-		return
+// Update (re)derives the cipher's key schedule from the payload of a
+// 0x5e/0x4e initialisation packet. See Cipher.DeriveKeymap for details
+// of the algorithm used by a given cipher. A zero-value SecurityKey
+// has no cipher configured and Update is a no-op, the same as an
+// empty key map.
+func (s *SecurityKey) Update(packet []byte) error {
+	if s.cipher == nil {
+		log.Debugf("%%PHEV_SEC_KEY_CLEAR%% No cipher configured")
+		return nil
 	}
-	// Calculate security key from provided packet.
-	result := (packet[4] & 0x8) >> 3
-	result |= (packet[5] & 0x8) >> 2
-	result |= (packet[6] & 0x8) >> 1
-	result |= (packet[7] & 0x8)
-	result |= (packet[8] & 0x8) << 1
-	result |= (packet[9] & 0x8) << 2
-	result |= (packet[10] & 0x8) << 3
-	result |= (packet[11] & 0x8) << 4
-	s.securityKey = byte(result)
-	// From this key, generate the key map.
-	s_key := int(s.securityKey)
-	s.keyMap = make([]byte, 256)
-	for i := 0; i < len(s.keyMap); i++ {
-		s.keyMap[i] = byte(i)
-	}
-
-	index := 0
-	for i := 0; i < 256; i++ {
-		index += int(s.keyMap[i])
-		index += s_key
-		index %= 256
-		temp := s.keyMap[i]
-		s.keyMap[i] = s.keyMap[index]
-		s.keyMap[index] = temp
-	}
-	// Reset the keymap send/receive indices.
-	s.sNum = 0
-	s.rNum = 0
-	log.Debugf("%%PHEV_SEC_KEY_UPDATE%% Updated security key")
+	return s.cipher.DeriveKeymap(packet)
 }
 
-// Fetch and optionally increment the index for the received
-// key (sent from the car). The key is incremented after a packet
-// of type 0x6f is sent from the car. Otherwise the same key index
-// is used.
-// The returned value is XORed with the raw packet from the car before
-// decoding it.
+// RKey returns the key for the received (from the car) direction. The
+// key is incremented after a packet of type 0x6f is received from the
+// car; otherwise the same key index is reused. The returned value is
+// XORed with the raw packet from the car before decoding it. A
+// zero-value SecurityKey has no cipher configured and always returns
+// 0, the same as an empty key map.
 func (s *SecurityKey) RKey(increment bool) byte {
-	if len(s.keyMap) == 0 {
-		log.Tracef("r_key=empty")
+	if s.cipher == nil {
 		return 0
 	}
-	ret := s.rNum
-	if increment {
-		s.rNum++
-	}
-	log.Tracef("r_key=%d", s.keyMap[ret])
-	return s.keyMap[ret]
+	return s.cipher.RecvKey(increment)
 }
 
-// Fetch and optionally increment the index for the send
-// key (sent to the car). The key is incremented after a packet
-// of type 0xf6 is sent to the car. Otherwise the same key index
-// is used.
-// The returned value is XORed with the raw packet before sending
-// it to the car.
+// SKey returns the key for the sent (to the car) direction. The key is
+// incremented after a packet of type 0xf6 is sent to the car;
+// otherwise the same key index is reused. The returned value is XORed
+// with the raw packet before sending it to the car. A zero-value
+// SecurityKey has no cipher configured and always returns 0, the same
+// as an empty key map.
 func (s *SecurityKey) SKey(increment bool) byte {
-	if len(s.keyMap) == 0 {
-		log.Tracef("s_key=empty")
+	if s.cipher == nil {
 		return 0
 	}
-	ret := s.sNum
-	if increment {
-		s.sNum++
-	}
-	log.Tracef("s_key=%d", s.keyMap[ret])
-	return s.keyMap[ret]
+	return s.cipher.SendKey(increment)
 }
 
 func XorMessageWith(message []byte, xor byte) []byte {
@@ -153,12 +170,26 @@ func ValidateChecksum(message []byte) bool {
 	return Checksum(message) == wantSum
 }
 
-// Validate and decode message. Returns the decoded/validated message,
-// plus any trailing data.
-func ValidateAndDecodeMessage(message []byte) ([]byte, byte, []byte) {
+// msgTypeFromCar is the type byte of frames sent by the car that
+// advance the receive key index (see RKey).
+const msgTypeFromCar = 0x6f
+
+// ValidateAndDecodeMessage validates and decodes message. Returns the
+// decoded/validated message, plus any trailing data.
+//
+// If cipher is non-nil, the decoded xor key is additionally checked
+// against cipher's expected receive key: a replayed, reordered, or
+// dropped frame will still pass the checksum (the xor key is read from
+// the frame itself, so any validly encoded frame decodes) but will no
+// longer be at the expected position in the key schedule. A mismatch returns ErrKeyDesync and invokes
+// onDesync, if set, instead of returning a decoded message; callers
+// should treat this as a signal to re-handshake rather than trust the
+// frame. cipher may be nil to skip this check, e.g. for callers that
+// have not yet completed the handshake.
+func ValidateAndDecodeMessage(cipher Cipher, message []byte, onDesync DesyncFunc) ([]byte, byte, []byte, error) {
 	if len(message) < 4 {
 		log.Debugf("Short msg\n")
-		return nil, 0, nil
+		return nil, 0, nil, nil
 	}
 	xor := message[2]
 	msg := XorMessageWith(message, xor)
@@ -166,13 +197,30 @@ func ValidateAndDecodeMessage(message []byte) ([]byte, byte, []byte) {
 		xor ^= 1
 		msg = XorMessageWith(message, xor)
 		if !ValidateChecksum(msg) {
+			atomic.AddUint64(&decryptBadsumTotal, 1)
 			log.Debugf("Bad sum for (%s)\n", hex.EncodeToString(message))
-			return nil, 0, nil
+			return nil, 0, nil, nil
+		}
+	}
+	if cipher != nil {
+		want := cipher.RecvKey(false)
+		if xor != want && xor != want^1 {
+			atomic.AddUint64(&decryptDesyncTotal, 1)
+			log.Debugf("Key desync: got %#x, want %#x (%s)\n", xor, want, hex.EncodeToString(message))
+			if onDesync != nil {
+				onDesync(xor, want)
+			}
+			return nil, 0, nil, ErrKeyDesync
+		}
+		// Only a frame of type 0x6f advances the receive key index;
+		// other frame types are re-read at the same index (see RKey).
+		if msg[0] == msgTypeFromCar {
+			cipher.RecvKey(true)
 		}
 	}
 	length := msg[1] + 2
 	if len(message) > int(length) {
-		return msg[:length], xor, message[length:]
+		return msg[:length], xor, message[length:], nil
 	}
-	return msg[:length], xor, nil
+	return msg[:length], xor, nil, nil
 }
@@ -0,0 +1,103 @@
+package protocol_test
+
+import (
+	"bytes"
+	cryptorand "crypto/rand"
+	"testing"
+
+	_ "github.com/theorbtwo/phev2mqtt/ciphers"
+	"github.com/theorbtwo/phev2mqtt/protocol"
+)
+
+// TestSecurityKeyZeroValue checks that a bare &SecurityKey{}, with no
+// cipher configured, behaves like an empty key map rather than
+// panicking.
+func TestSecurityKeyZeroValue(t *testing.T) {
+	s := &protocol.SecurityKey{}
+
+	if _, err := s.GenerateProposal(); err != nil {
+		t.Fatalf("GenerateProposal() error = %v", err)
+	}
+	if err := s.AcceptProposal(); err != nil {
+		t.Fatalf("AcceptProposal() error = %v", err)
+	}
+	if err := s.Update([]byte{0x5e, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if got := s.RKey(true); got != 0 {
+		t.Errorf("RKey() = %d, want 0 with no cipher configured", got)
+	}
+	if got := s.SKey(true); got != 0 {
+		t.Errorf("SKey() = %d, want 0 with no cipher configured", got)
+	}
+}
+
+// TestSecurityKeyProposeAcceptSendReceive drives a SecurityKey through
+// a full session: proposing a key, accepting it (deriving the key
+// schedule), and using SKey to send frames that a peer, whose cipher
+// derived its schedule from the same proposal, decodes with
+// ValidateAndDecodeMessage.
+func TestSecurityKeyProposeAcceptSendReceive(t *testing.T) {
+	defer protocol.SetRandSource(cryptorand.Reader)
+	wantProposal := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	protocol.SetRandSource(bytes.NewReader(wantProposal))
+
+	appCipher, err := protocol.NewCipher("MY18")
+	if err != nil {
+		t.Fatalf("NewCipher() error = %v", err)
+	}
+	carCipher, err := protocol.NewCipher("MY18")
+	if err != nil {
+		t.Fatalf("NewCipher() error = %v", err)
+	}
+
+	app := protocol.NewSecurityKey(appCipher)
+	car := protocol.NewSecurityKey(carCipher)
+
+	proposal, err := app.GenerateProposal()
+	if err != nil {
+		t.Fatalf("GenerateProposal() error = %v", err)
+	}
+	if !bytes.Equal(proposal, wantProposal) {
+		t.Fatalf("GenerateProposal() = %x, want %x", proposal, wantProposal)
+	}
+
+	// Both sides derive their key schedule from the same 0x5e/0x4e
+	// init packet payload: four zero bytes followed by the proposal.
+	initPacket := append([]byte{0x0, 0x0, 0x0, 0x0}, proposal...)
+	if err := car.Update(initPacket); err != nil {
+		t.Fatalf("car.Update() error = %v", err)
+	}
+	if err := app.AcceptProposal(); err != nil {
+		t.Fatalf("app.AcceptProposal() error = %v", err)
+	}
+	if app.State != protocol.SecurityKeyAccepted {
+		t.Fatalf("app.State = %v, want SecurityKeyAccepted", app.State)
+	}
+
+	plaintext := makeFrame(0x6f, []byte{0xaa, 0xbb})
+	key := app.SKey(true)
+	encoded := protocol.XorMessageWith(plaintext, key)
+
+	got, _, _, err := protocol.ValidateAndDecodeMessage(carCipher, encoded, nil)
+	if err != nil {
+		t.Fatalf("ValidateAndDecodeMessage() error = %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatalf("got = %x, want %x", got, plaintext)
+	}
+
+	// A second frame, sent through app and received through the car's
+	// cipher, should also round-trip: confirms SKey and the car's
+	// receive index stay in step across more than one frame.
+	plaintext2 := makeFrame(0x6f, []byte{0xcc})
+	key2 := app.SKey(true)
+	encoded2 := protocol.XorMessageWith(plaintext2, key2)
+	got2, _, _, err := protocol.ValidateAndDecodeMessage(carCipher, encoded2, nil)
+	if err != nil {
+		t.Fatalf("second frame: ValidateAndDecodeMessage() error = %v", err)
+	}
+	if !bytes.Equal(got2, plaintext2) {
+		t.Fatalf("second frame: got = %x, want %x", got2, plaintext2)
+	}
+}